@@ -0,0 +1,168 @@
+// Package oidc implements the OIDC authorization-code-with-PKCE flow used by
+// the funnel-exposed login page, in place of a shared password.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	goidc "github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+const sessionName = "ynab-updater-oidc"
+
+// Config holds the settings needed to talk to an OIDC provider. It is
+// populated from the oidc section of the authoriser's layered configuration.
+type Config struct {
+	IssuerURL       string
+	ClientID        string
+	ClientSecret    string
+	RedirectURL     string
+	AllowedSubjects []string
+}
+
+// Authenticator drives the login/callback handlers for a single configured
+// IdP and enforces the AllowedSubjects allow-list.
+type Authenticator struct {
+	verifier     *goidc.IDTokenVerifier
+	oauth2Config oauth2.Config
+	sessions     *sessions.CookieStore
+	allowed      map[string]bool
+}
+
+// New discovers the IdP's OIDC configuration and returns an Authenticator
+// ready to serve the login and callback handlers.
+func New(ctx context.Context, conf Config, sessionKey []byte) (*Authenticator, error) {
+	provider, err := goidc.NewProvider(ctx, conf.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("discovering oidc provider: %w", err)
+	}
+
+	allowed := make(map[string]bool, len(conf.AllowedSubjects))
+	for _, s := range conf.AllowedSubjects {
+		allowed[s] = true
+	}
+
+	// The state and verifier are a few dozen bytes, so they fit in the
+	// cookie itself rather than needing a server-side session store;
+	// LoginHandler is reachable unauthenticated over the public Funnel
+	// listener, so there's no session file for a caller to pile up by
+	// spamming it. Funnel terminates TLS in front of us, so Secure is safe
+	// to set unconditionally, and the cookie only needs to live for the
+	// seconds between redirect and callback.
+	store := sessions.NewCookieStore(sessionKey)
+	store.Options = &sessions.Options{
+		MaxAge:   5 * 60,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	return &Authenticator{
+		verifier: provider.Verifier(&goidc.Config{ClientID: conf.ClientID}),
+		oauth2Config: oauth2.Config{
+			ClientID:     conf.ClientID,
+			ClientSecret: conf.ClientSecret,
+			RedirectURL:  conf.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{goidc.ScopeOpenID, "email", "offline_access"},
+		},
+		sessions: store,
+		allowed:  allowed,
+	}, nil
+}
+
+func randString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// LoginHandler redirects the browser to the IdP's authorization endpoint
+// with a random state and a PKCE code_verifier, stashing both in a
+// short-lived session cookie so CallbackHandler can check them.
+func (a *Authenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := randString(16)
+	if err != nil {
+		http.Error(w, "error generating state", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	session, _ := a.sessions.Get(r, sessionName)
+	session.Values["state"] = state
+	session.Values["verifier"] = verifier
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, "error saving session", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, a.oauth2Config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// CallbackHandler exchanges the authorization code for tokens, validates the
+// ID token, and checks the caller's email/sub against the allow-list. On
+// success it hands the ResponseWriter and the *oauth2.Token (access +
+// refresh token) to onSuccess, which is responsible for writing the
+// response.
+func (a *Authenticator) CallbackHandler(onSuccess func(http.ResponseWriter, *oauth2.Token)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := a.sessions.Get(r, sessionName)
+		if err != nil {
+			http.Error(w, "no session", http.StatusBadRequest)
+			return
+		}
+
+		state, _ := session.Values["state"].(string)
+		verifier, _ := session.Values["verifier"].(string)
+		if state == "" || r.URL.Query().Get("state") != state {
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			return
+		}
+
+		oauth2Token, err := a.oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+		if err != nil {
+			http.Error(w, "exchange failed", http.StatusBadRequest)
+			return
+		}
+
+		idToken, err := a.verifyIDToken(r.Context(), oauth2Token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var claims struct {
+			Email         string `json:"email"`
+			EmailVerified bool   `json:"email_verified"`
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			http.Error(w, "error parsing claims", http.StatusInternalServerError)
+			return
+		}
+
+		emailAllowed := claims.EmailVerified && a.allowed[claims.Email]
+		if !emailAllowed && !a.allowed[idToken.Subject] {
+			http.Error(w, "not authorized", http.StatusForbidden)
+			return
+		}
+
+		onSuccess(w, oauth2Token)
+	}
+}
+
+func (a *Authenticator) verifyIDToken(ctx context.Context, token *oauth2.Token) (*goidc.IDToken, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+	return a.verifier.Verify(ctx, rawIDToken)
+}
@@ -1,97 +1,169 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/gregdel/pushover"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/confmap"
+	"github.com/knadh/koanf/providers/env"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
+	"google.golang.org/grpc"
 	"tailscale.com/tsnet"
+
+	"github.com/jcarrag/ynab-updater/auth/oidc"
+	"github.com/jcarrag/ynab-updater/secret"
 )
 
-// func StartFunnelServer(authKey string, passwordChan chan<- string) {
-func StartFunnelServer(authKey string, password *string) {
-	s := &tsnet.Server{Hostname: "ynab-updater", AuthKey: authKey}
-	// defer s.Close()
+//go:embed web/*.html
+var webFS embed.FS
+
+var tmpl = template.Must(template.ParseFS(webFS, "web/*.html"))
+
+// renderError writes status with the error.html template, falling back to a
+// plain http.Error if rendering itself fails.
+func renderError(w http.ResponseWriter, message string, status int) {
+	w.WriteHeader(status)
+	if err := tmpl.ExecuteTemplate(w, "error.html", map[string]string{"Message": message}); err != nil {
+		http.Error(w, message, status)
+	}
+}
+
+// StartFunnelServer starts the funnel-exposed OIDC login and the
+// tailnet-only WhoIs listener. It returns a shutdown hook the caller can
+// invoke to tear everything down early, and a done channel that is closed
+// once the server has shut down (either because a caller authenticated
+// successfully, or because shutdown was called directly).
+func StartFunnelServer(hostname, authKey string, oidcConf oidc.Config, authorizedUsers []string, tailnetSecret string, store *secret.Store) (shutdown func() error, done <-chan struct{}) {
+	s := &tsnet.Server{Hostname: hostname, AuthKey: authKey}
 
 	ln, err := s.ListenFunnel("tcp", ":443")
 	if err != nil {
 		log.Fatal(err)
 		os.Exit(1)
 	}
-	// defer ln.Close()
-
-	http.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w,
-			`<html>
-                         <meta name="viewport" content='width=device-width,initial-scale=1,maximum-scale=1' />
-                         <form action='/' method='POST' style='height:50%;margin-top:25%;'>
-                           <input id='password' name='password' type='password' style='width:100%;height:10%;margin-bottom:10px;font-size:30px;'/>
-                           <button style='width:100%;height:10%;font-size:30px;'>Submit</button>
-                         </form>`,
-		)
-	})
 
-	http.HandleFunc("POST /", func(w http.ResponseWriter, r *http.Request) {
-		defer ln.Close()
-		// defer s.Close()
+	tsLn, err := s.Listen("tcp", ":80")
+	if err != nil {
+		log.Fatal(err)
+		os.Exit(1)
+	}
 
-		r.ParseForm()
-		// passwordChan <- r.FormValue("password")
-		*password = r.FormValue("password")
-		fmt.Fprintln(w, "<html><script type='text/javascript'>window.alert('Saved password');</script>")
-		// FIXME: how to shutdown server without ending whole process
-	})
+	srv := &http.Server{}
+	tsSrv := &http.Server{}
+
+	doneCh := make(chan struct{})
+	var shutdownOnce sync.Once
+	var shutdownErr error
+	shutdownFn := func() error {
+		shutdownOnce.Do(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			shutdownErr = errors.Join(srv.Shutdown(ctx), tsSrv.Shutdown(ctx))
+			s.Close()
+			close(doneCh)
+		})
+		return shutdownErr
+	}
 
-	http.Serve(ln, nil)
-}
+	// Tailnet members are identified via WhoIs instead of being sent through
+	// the funnel password/OIDC form.
+	tailnetMux := http.NewServeMux()
+	tailnetMux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		lc, err := s.LocalClient()
+		if err != nil {
+			renderError(w, "error getting local client", http.StatusInternalServerError)
+			return
+		}
 
-func main() {
-	type Config struct {
-		OauthClientId     string `toml:"TS_OAUTH_CLIENT_ID"`
-		OauthClientSecret string `toml:"TS_OAUTH_CLIENT_SECRET"`
-		PushoverApiKey    string `toml:"PUSHOVER_API_KEY"`
-		PushoverUserKey   string `toml:"PUSHOVER_USER_KEY"`
-	}
+		who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+		if err != nil || who.UserProfile == nil || !isAuthorizedUser(who.UserProfile.LoginName, authorizedUsers) {
+			renderError(w, "not a recognised tailnet user", http.StatusForbidden)
+			return
+		}
 
-	confPath := path.Join(os.Getenv("YNAB_CONFIG_PATH"),"/settings.toml")
+		if err := store.Set(tailnetSecret); err != nil {
+			renderError(w, "error storing secret", http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.ExecuteTemplate(w, "saved.html", nil); err != nil {
+			log.Println("error rendering saved.html", err)
+		}
+		go shutdownFn()
+	})
+	tsSrv.Handler = tailnetMux
 
-	var conf Config
-	_, err := toml.DecodeFile(confPath, &conf)
-	if err != nil {
-		log.Fatal("toml.DecodeFile error", err)
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		log.Fatal("error generating session key", err)
 		os.Exit(1)
 	}
 
-	var oauthConfig = &clientcredentials.Config{
-		ClientID:     conf.OauthClientId,
-		ClientSecret: conf.OauthClientSecret,
-		TokenURL:     "https://api.tailscale.com/api/v2/oauth/token",
+	authenticator, err := oidc.New(context.Background(), oidcConf, sessionKey)
+	if err != nil {
+		log.Fatal("error setting up oidc authenticator", err)
+		os.Exit(1)
 	}
 
-	client := oauthConfig.Client(context.Background())
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", authenticator.LoginHandler)
+
+	mux.HandleFunc("GET /callback", authenticator.CallbackHandler(func(w http.ResponseWriter, token *oauth2.Token) {
+		tokens, _ := json.Marshal(map[string]string{
+			"access_token":  token.AccessToken,
+			"refresh_token": token.RefreshToken,
+		})
+		if err := store.Set(string(tokens)); err != nil {
+			renderError(w, "error storing secret", http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.ExecuteTemplate(w, "saved.html", nil); err != nil {
+			log.Println("error rendering saved.html", err)
+		}
+		go shutdownFn()
+	}))
+	srv.Handler = mux
+
+	go tsSrv.Serve(tsLn)
+	go func() {
+		srv.Serve(ln)
+	}()
+
+	return shutdownFn, doneCh
+}
 
-	type CreateAuthKeyResponse struct {
+// createAuthKey mints a fresh, single-use, 10-second tailscale authkey for
+// the funnel server's tsnet.Server to register with.
+func createAuthKey(client *http.Client) (string, error) {
+	type createAuthKeyResponse struct {
 		Id      string `json:"id"`
 		Key     string `json:"key"`
 		Created string `json:"created"`
 		Expires string `json:"expires"`
 	}
 
-	// create authKey
-
 	payload := strings.NewReader(`
                 {
                   "capabilities": {
@@ -108,36 +180,189 @@ func main() {
                   "description": "ynab-updated_authoriser"
                 }`)
 
-	createAuthKeyResp, err := client.Post("https://api.tailscale.com/api/v2/tailnet/-/keys?all=true", "application/json", payload)
+	resp, err := client.Post("https://api.tailscale.com/api/v2/tailnet/-/keys?all=true", "application/json", payload)
 	if err != nil {
-		log.Fatal("error creating authKey", err)
-		os.Exit(1)
+		return "", err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var authKey createAuthKeyResponse
+	if err := json.Unmarshal(body, &authKey); err != nil {
+		return "", err
+	}
+
+	return authKey.Key, nil
+}
+
+func isAuthorizedUser(loginName string, authorizedUsers []string) bool {
+	for _, u := range authorizedUsers {
+		if u == loginName {
+			return true
+		}
 	}
+	return false
+}
+
+// Config is unmarshalled from koanf after defaults, the -conf TOML file(s),
+// and YNAB_-prefixed env overrides have all been layered on top of each
+// other, in that order.
+type Config struct {
+	Tailscale struct {
+		Oauth struct {
+			ClientId     string `koanf:"client_id"`
+			ClientSecret string `koanf:"client_secret"`
+		} `koanf:"oauth"`
+	} `koanf:"tailscale"`
+	Pushover struct {
+		ApiKey  string `koanf:"api_key"`
+		UserKey string `koanf:"user_key"`
+	} `koanf:"pushover"`
+	Oidc struct {
+		IssuerUrl       string   `koanf:"issuer_url"`
+		ClientId        string   `koanf:"client_id"`
+		ClientSecret    string   `koanf:"client_secret"`
+		AllowedSubjects []string `koanf:"allowed_subjects"`
+		RedirectUrl     string   `koanf:"redirect_url"`
+	} `koanf:"oidc"`
+	AuthorizedUsers []string `koanf:"authorized_users"`
+	TailnetSecret   string   `koanf:"tailnet_secret"`
+	Funnel          struct {
+		Hostname string `koanf:"hostname"`
+	} `koanf:"funnel"`
+	Socket struct {
+		Path        string   `koanf:"path"`
+		AllowedUids []uint32 `koanf:"allowed_uids"`
+	} `koanf:"socket"`
+}
 
-	createAuthKeyBody, err := io.ReadAll(createAuthKeyResp.Body)
+// flatEnvKeys are top-level (unnested) Config fields whose own koanf tag
+// contains an underscore, so the generic "split on the first underscore"
+// rule in envKey below would mistake part of the name for a path separator.
+var flatEnvKeys = map[string]string{
+	"authorized_users": "authorized_users",
+	"tailnet_secret":   "tailnet_secret",
+}
+
+// envKey turns YNAB_PUSHOVER_API_KEY into "pushover.api_key": the first
+// underscore after the prefix is treated as the dotted-path separator (or,
+// for the one nested section, the first two), the rest are left as-is. Flat
+// keys listed in flatEnvKeys are passed through unchanged.
+func envKey(s string) string {
+	s = strings.ToLower(strings.TrimPrefix(s, "YNAB_"))
+	if path, ok := flatEnvKeys[s]; ok {
+		return path
+	}
+	if rest, ok := strings.CutPrefix(s, "tailscale_oauth_"); ok {
+		return "tailscale.oauth." + rest
+	}
+	if i := strings.IndexByte(s, '_'); i >= 0 {
+		return s[:i] + "." + s[i+1:]
+	}
+	return s
+}
+
+func loadConfig(confFiles []string) (Config, error) {
+	k := koanf.New(".")
+
+	defaults := map[string]interface{}{
+		"socket.path":     "/tmp/ynab-updater_authoriser.sock",
+		"funnel.hostname": "ynab-updater",
+	}
+	if err := k.Load(confmap.Provider(defaults, "."), nil); err != nil {
+		return Config{}, fmt.Errorf("loading defaults: %w", err)
+	}
+
+	for _, f := range confFiles {
+		if err := k.Load(file.Provider(f), toml.Parser()); err != nil {
+			return Config{}, fmt.Errorf("loading %s: %w", f, err)
+		}
+	}
+
+	if err := k.Load(env.Provider("YNAB_", ".", envKey), nil); err != nil {
+		return Config{}, fmt.Errorf("loading env overrides: %w", err)
+	}
+
+	var conf Config
+	if err := k.Unmarshal("", &conf); err != nil {
+		return Config{}, fmt.Errorf("unmarshalling config: %w", err)
+	}
+	return conf, nil
+}
+
+func main() {
+	var confFiles []string
+	pflag.StringArrayVar(&confFiles, "conf", nil, "path to a settings TOML file (may be repeated)")
+	pflag.Parse()
+
+	conf, err := loadConfig(confFiles)
 	if err != nil {
-		log.Fatal("error reading response createAuthKeyBody", err)
+		log.Fatal("error loading config", err)
 		os.Exit(1)
 	}
 
-	fmt.Println("createAuthKeyBody:", string(createAuthKeyBody))
+	var oauthConfig = &clientcredentials.Config{
+		ClientID:     conf.Tailscale.Oauth.ClientId,
+		ClientSecret: conf.Tailscale.Oauth.ClientSecret,
+		TokenURL:     "https://api.tailscale.com/api/v2/oauth/token",
+	}
 
-	createAuthKey := CreateAuthKeyResponse{}
-	json.Unmarshal([]byte(createAuthKeyBody), &createAuthKey)
+	client := oauthConfig.Client(context.Background())
 
-	// the password stored in memory
+	// the secret, stored encrypted at rest
 
-	// passwordChan := make(chan string, 1)
-	password := ""
+	store, err := secret.NewStore()
+	if err != nil {
+		log.Fatal("error initializing secret store", err)
+		os.Exit(1)
+	}
 
 	// start funnel server
 
-	go StartFunnelServer(createAuthKey.Key, &password) //passwordChan)
+	oidcConf := oidc.Config{
+		IssuerURL:       conf.Oidc.IssuerUrl,
+		ClientID:        conf.Oidc.ClientId,
+		ClientSecret:    conf.Oidc.ClientSecret,
+		RedirectURL:     conf.Oidc.RedirectUrl,
+		AllowedSubjects: conf.Oidc.AllowedSubjects,
+	}
+
+	authKey, err := createAuthKey(client)
+	if err != nil {
+		log.Fatal("error creating authKey", err)
+		os.Exit(1)
+	}
+
+	_, done := StartFunnelServer(conf.Funnel.Hostname, authKey, oidcConf, conf.AuthorizedUsers, conf.TailnetSecret, store)
+
+	// Whenever a funnel session ends (done closes) without a secret having
+	// been stored, mint a fresh authKey and start a new session. done only
+	// closes after a successful login or a call to the shutdown hook, which
+	// is discarded here, so a session is not restarted when its authKey
+	// expires.
+	go func() {
+		for {
+			<-done
+			if _, ok := store.Open(); ok {
+				break
+			}
+			log.Println("funnel session ended without a secret, starting a new one")
+			authKey, err := createAuthKey(client)
+			if err != nil {
+				log.Fatal("error creating authKey", err)
+				os.Exit(1)
+			}
+			_, done = StartFunnelServer(conf.Funnel.Hostname, authKey, oidcConf, conf.AuthorizedUsers, conf.TailnetSecret, store)
+		}
+	}()
 
 	// send pushover notification
 
-	app := pushover.New(conf.PushoverApiKey)
-	recipient := pushover.NewRecipient(conf.PushoverUserKey)
+	app := pushover.New(conf.Pushover.ApiKey)
+	recipient := pushover.NewRecipient(conf.Pushover.UserKey)
 	message := &pushover.Message{
 		Message:  "Log into ynab-updater",
 		Title:    "Log in",
@@ -158,7 +383,7 @@ func main() {
 	// start local server
 
 	log.Printf("starting localhost server")
-	const socketPath = "/tmp/ynab-updater_authoriser.sock"
+	socketPath := conf.Socket.Path
 	socket, err := net.Listen("unix", socketPath)
 	if err != nil {
 		log.Fatal("error opening unix socket", err)
@@ -174,28 +399,12 @@ func main() {
 		os.Exit(1)
 	}()
 
-	localMux := http.NewServeMux()
-	localMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// msg := "init"
-		// select {
-		// case password = <-passwordChan:
-		//         msg = password
-		// default: msg = "no password provided yet"
-		// }
-		// fmt.Fprintln(w, "<html>Password: ", password)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		if password == "" {
-			w.WriteHeader(404)
-		} else {
-			w.WriteHeader(200)
-			bytes.NewBufferString(string(password)).WriteTo(w)
-		}
-	})
-
-	localSrv := &http.Server{
-		Handler: localMux,
-	}
-
-	localSrv.Serve(socket)
+	grpcServer := grpc.NewServer(
+		grpc.Creds(secret.TransportCredentials{}),
+		grpc.UnaryInterceptor(secret.AuthInterceptor(conf.Socket.AllowedUids)),
+		grpc.StreamInterceptor(secret.StreamAuthInterceptor(conf.Socket.AllowedUids)),
+	)
+	secret.RegisterSecretServiceServer(grpcServer, secret.NewServer(store))
 
+	grpcServer.Serve(socket)
 }
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestEnvKey(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"nested section", "YNAB_PUSHOVER_API_KEY", "pushover.api_key"},
+		{"tailscale oauth special case", "YNAB_TAILSCALE_OAUTH_CLIENT_ID", "tailscale.oauth.client_id"},
+		{"flat key with underscore", "YNAB_AUTHORIZED_USERS", "authorized_users"},
+		{"flat key with underscore, tailnet secret", "YNAB_TAILNET_SECRET", "tailnet_secret"},
+		{"flat key without underscore", "YNAB_HOSTNAME", "hostname"},
+		{"single nested key", "YNAB_SOCKET_PATH", "socket.path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := envKey(tt.in); got != tt.want {
+				t.Errorf("envKey(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAuthorizedUser(t *testing.T) {
+	authorizedUsers := []string{"alice@example.com", "bob@example.com"}
+
+	tests := []struct {
+		name      string
+		loginName string
+		want      bool
+	}{
+		{"authorized user", "alice@example.com", true},
+		{"another authorized user", "bob@example.com", true},
+		{"unauthorized user", "eve@example.com", false},
+		{"empty login name", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAuthorizedUser(tt.loginName, authorizedUsers); got != tt.want {
+				t.Errorf("isAuthorizedUser(%q) = %v, want %v", tt.loginName, got, tt.want)
+			}
+		})
+	}
+
+	if isAuthorizedUser("alice@example.com", nil) {
+		t.Error("isAuthorizedUser with an empty list should always return false")
+	}
+}
@@ -0,0 +1,39 @@
+package secret
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthInterceptor(t *testing.T) {
+	handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		allowedUID []uint32
+		wantErr    codes.Code
+	}{
+		{"allowed uid", peerContext(PeerCred{UID: 1000}), []uint32{1000}, codes.OK},
+		{"uid not in allow-list", peerContext(PeerCred{UID: 1000}), []uint32{1001}, codes.PermissionDenied},
+		{"empty allow-list", peerContext(PeerCred{UID: 1000}), nil, codes.PermissionDenied},
+		{"missing peer credential", context.Background(), []uint32{1000}, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := AuthInterceptor(tt.allowedUID)(tt.ctx, nil, &grpc.UnaryServerInfo{}, handler)
+			if status.Code(err) != tt.wantErr {
+				t.Errorf("AuthInterceptor() error = %v, want code %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func peerContext(cred PeerCred) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: cred})
+}
@@ -0,0 +1,91 @@
+package secret
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// These types and the service registration below mirror what
+// protoc-gen-go/protoc-gen-go-grpc would produce from secret.proto, hand
+// written because the wire codec is JSON (see codec.go) rather than
+// protobuf.
+
+// GetSecretRequest is the (empty) request for GetSecret and WaitForSecret.
+type GetSecretRequest struct{}
+
+// Secret carries the decrypted value back to an authorized caller.
+type Secret struct {
+	Value string `json:"value"`
+}
+
+// Ready is streamed back by WaitForSecret once a secret has been stored.
+type Ready struct{}
+
+// SecretServiceServer is implemented by Server.
+type SecretServiceServer interface {
+	GetSecret(context.Context, *GetSecretRequest) (*Secret, error)
+	WaitForSecret(*GetSecretRequest, SecretService_WaitForSecretServer) error
+}
+
+// SecretService_WaitForSecretServer streams Ready messages to the caller.
+type SecretService_WaitForSecretServer interface {
+	Send(*Ready) error
+	grpc.ServerStream
+}
+
+// RegisterSecretServiceServer registers srv as the handler for the
+// secret.SecretService gRPC service.
+func RegisterSecretServiceServer(s grpc.ServiceRegistrar, srv SecretServiceServer) {
+	s.RegisterService(&secretServiceDesc, srv)
+}
+
+var secretServiceDesc = grpc.ServiceDesc{
+	ServiceName: "secret.SecretService",
+	HandlerType: (*SecretServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetSecret",
+			Handler:    getSecretHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WaitForSecret",
+			Handler:       waitForSecretHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "secret/secret.proto",
+}
+
+func getSecretHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	in := new(GetSecretRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SecretServiceServer).GetSecret(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/secret.SecretService/GetSecret"}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(SecretServiceServer).GetSecret(ctx, req.(*GetSecretRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func waitForSecretHandler(srv any, stream grpc.ServerStream) error {
+	in := new(GetSecretRequest)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	return srv.(SecretServiceServer).WaitForSecret(in, &secretServiceWaitForSecretServer{stream})
+}
+
+type secretServiceWaitForSecretServer struct {
+	grpc.ServerStream
+}
+
+func (s *secretServiceWaitForSecretServer) Send(r *Ready) error {
+	return s.ServerStream.SendMsg(r)
+}
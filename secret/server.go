@@ -0,0 +1,51 @@
+package secret
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const waitForSecretPollInterval = 500 * time.Millisecond
+
+// Server implements SecretServiceServer backed by a Store. Authorization
+// (the SO_PEERCRED / allowed-UID check) is enforced by AuthInterceptor, not
+// here.
+type Server struct {
+	store *Store
+}
+
+// NewServer returns a Server that reads the secret from store.
+func NewServer(store *Store) *Server {
+	return &Server{store: store}
+}
+
+func (s *Server) GetSecret(ctx context.Context, req *GetSecretRequest) (*Secret, error) {
+	value, ok := s.store.Open()
+	if !ok {
+		return nil, status.Error(codes.NotFound, "no secret has been set yet")
+	}
+	return &Secret{Value: value}, nil
+}
+
+func (s *Server) WaitForSecret(req *GetSecretRequest, stream SecretService_WaitForSecretServer) error {
+	if _, ok := s.store.Open(); ok {
+		return stream.Send(&Ready{})
+	}
+
+	ticker := time.NewTicker(waitForSecretPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+			if _, ok := s.store.Open(); ok {
+				return stream.Send(&Ready{})
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Package secret holds the in-memory secret handed out over the unix
+// socket, and the gRPC service that serves it to authorized local callers.
+package secret
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Store holds the funnel/OIDC/tailnet-derived secret encrypted at rest. The
+// chacha20poly1305 key is derived from a random nonce generated at boot.
+// Over the socket, the plaintext is only decrypted by Server's handlers,
+// which run after AuthInterceptor / StreamAuthInterceptor have checked the
+// caller's SO_PEERCRED uid.
+type Store struct {
+	mu     sync.Mutex
+	aead   cipher.AEAD
+	nonce  []byte
+	sealed []byte
+}
+
+// NewStore generates a fresh boot-time key and returns an empty Store.
+func NewStore() (*Store, error) {
+	bootNonce := make([]byte, 32)
+	if _, err := rand.Read(bootNonce); err != nil {
+		return nil, fmt.Errorf("generating boot nonce: %w", err)
+	}
+	key := sha256.Sum256(bootNonce)
+
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("initializing aead: %w", err)
+	}
+
+	return &Store{aead: aead}, nil
+}
+
+// Set encrypts and stores plaintext, replacing whatever was there before.
+func (s *Store) Set(plaintext string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+
+	s.nonce = nonce
+	s.sealed = s.aead.Seal(nil, nonce, []byte(plaintext), nil)
+	return nil
+}
+
+// Open decrypts and returns the stored secret. ok is false if nothing has
+// been stored yet.
+func (s *Store) Open() (value string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sealed == nil {
+		return "", false
+	}
+
+	plaintext, err := s.aead.Open(nil, s.nonce, s.sealed, nil)
+	if err != nil {
+		return "", false
+	}
+	return string(plaintext), true
+}
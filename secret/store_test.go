@@ -0,0 +1,45 @@
+package secret
+
+import "testing"
+
+func TestStore_SetOpen(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	if _, ok := store.Open(); ok {
+		t.Fatal("Open() on a fresh store should return ok = false")
+	}
+
+	if err := store.Set("hunter2"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	value, ok := store.Open()
+	if !ok {
+		t.Fatal("Open() after Set() should return ok = true")
+	}
+	if value != "hunter2" {
+		t.Errorf("Open() = %q, want %q", value, "hunter2")
+	}
+}
+
+func TestStore_SetReplacesPrevious(t *testing.T) {
+	store, err := NewStore()
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	if err := store.Set("first"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := store.Set("second"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	value, ok := store.Open()
+	if !ok || value != "second" {
+		t.Errorf("Open() = (%q, %v), want (%q, true)", value, ok, "second")
+	}
+}